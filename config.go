@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/fortuna/ss-example/service"
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+	"gopkg.in/yaml.v3"
+)
+
+// ListenerConfig describes a single TCP or UDP listener.
+type ListenerConfig struct {
+	// Type is either "tcp" or "udp".
+	Type string `yaml:"type"`
+	// Address is the listen address, e.g. ":8388".
+	Address string `yaml:"address"`
+	// Name optionally identifies the listener for key scoping. Defaults to Address.
+	Name string `yaml:"name,omitempty"`
+	// ProxyProtocol accepts a PROXY protocol v1/v2 header at the start of each
+	// connection, for deployments behind an L4 load balancer (HAProxy, AWS
+	// NLB, Envoy) that would otherwise hide the real client address.
+	ProxyProtocol bool `yaml:"proxy_protocol,omitempty"`
+}
+
+// KeyConfig describes a single access key and the ciphers/listeners it applies to.
+type KeyConfig struct {
+	// ID is a human-readable identifier used in metrics and logs.
+	ID     string `yaml:"id"`
+	Cipher string `yaml:"cipher"`
+	Secret string `yaml:"secret"`
+	// Listeners optionally restricts this key to a subset of listener names.
+	// If empty, the key is available on every listener.
+	Listeners []string `yaml:"listeners,omitempty"`
+}
+
+// Config is the top-level schema for the YAML config file passed via -config.
+type Config struct {
+	Listeners []ListenerConfig `yaml:"listeners"`
+	Keys      []KeyConfig      `yaml:"keys"`
+}
+
+// Service is a single listener paired with the access keys it accepts.
+type Service struct {
+	Name          string
+	Type          string
+	Address       string
+	ProxyProtocol bool
+	Keys          []service.AccessKey
+}
+
+// loadConfig reads and parses a YAML config file into one Service per listener.
+func loadConfig(path string) ([]*Service, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config %s: %w", path, err)
+	}
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+	if len(cfg.Listeners) == 0 {
+		return nil, fmt.Errorf("config must declare at least one listener")
+	}
+
+	keysByID := make(map[string]shadowaead.Cipher, len(cfg.Keys))
+	services := make([]*Service, 0, len(cfg.Listeners))
+	for _, l := range cfg.Listeners {
+		name := l.Name
+		if name == "" {
+			name = l.Address
+		}
+		svc := &Service{Name: name, Type: l.Type, Address: l.Address, ProxyProtocol: l.ProxyProtocol}
+		for _, k := range cfg.Keys {
+			if !keyAppliesTo(k, name) {
+				continue
+			}
+			cipher, ok := keysByID[k.ID+"|"+k.Cipher+"|"+k.Secret]
+			if !ok {
+				c, err := core.PickCipher(k.Cipher, nil, k.Secret)
+				if err != nil {
+					return nil, fmt.Errorf("key %q: %w", k.ID, err)
+				}
+				aead, ok := c.(shadowaead.Cipher)
+				if !ok {
+					return nil, fmt.Errorf("key %q: only AEAD ciphers are supported", k.ID)
+				}
+				cipher = aead
+				keysByID[k.ID+"|"+k.Cipher+"|"+k.Secret] = cipher
+			}
+			svc.Keys = append(svc.Keys, service.AccessKey{ID: k.ID, Cipher: cipher})
+		}
+		if len(svc.Keys) == 0 {
+			return nil, fmt.Errorf("listener %q has no usable keys", name)
+		}
+		services = append(services, svc)
+	}
+	return services, nil
+}
+
+func keyAppliesTo(k KeyConfig, listenerName string) bool {
+	if len(k.Listeners) == 0 {
+		return true
+	}
+	for _, name := range k.Listeners {
+		if name == listenerName {
+			return true
+		}
+	}
+	return false
+}
+
+// servicesFromFlags builds the deprecated TCP and UDP Services, both on one
+// address and sharing one key list, from the legacy `-s` and `-u` flags, so existing deployments keep working for one
+// release while they migrate to `-config`.
+func servicesFromFlags(addr string, ciphers []shadowaead.Cipher) []*Service {
+	keys := make([]service.AccessKey, len(ciphers))
+	for i, c := range ciphers {
+		// Preserve the historical numeric access-key label used before -config existed.
+		keys[i] = service.AccessKey{ID: fmt.Sprint(i), Cipher: c}
+	}
+	return []*Service{
+		{Name: addr, Type: "tcp", Address: addr, Keys: keys},
+		{Name: addr, Type: "udp", Address: addr, Keys: keys},
+	}
+}
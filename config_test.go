@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testConfigYAML = `
+listeners:
+  - name: public
+    type: tcp
+    address: ":8388"
+  - name: internal
+    type: tcp
+    address: ":8389"
+keys:
+  - id: everyone
+    cipher: AEAD_AES_128_GCM
+    secret: everyone-secret
+  - id: internal-only
+    cipher: AEAD_AES_128_GCM
+    secret: internal-secret
+    listeners: [internal]
+`
+
+func writeTestConfig(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatalf("writing test config: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfigKeyScopedToSubsetOfListeners(t *testing.T) {
+	services, err := loadConfig(writeTestConfig(t, testConfigYAML))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	byName := make(map[string]*Service, len(services))
+	for _, svc := range services {
+		byName[svc.Name] = svc
+	}
+
+	public, ok := byName["public"]
+	if !ok {
+		t.Fatalf("missing public listener")
+	}
+	if len(public.Keys) != 1 || public.Keys[0].ID != "everyone" {
+		t.Fatalf("public listener keys = %+v, want only %q", public.Keys, "everyone")
+	}
+
+	internal, ok := byName["internal"]
+	if !ok {
+		t.Fatalf("missing internal listener")
+	}
+	if len(internal.Keys) != 2 {
+		t.Fatalf("internal listener keys = %+v, want both keys", internal.Keys)
+	}
+}
+
+func TestLoadConfigNoUsableKeys(t *testing.T) {
+	const yaml = `
+listeners:
+  - name: public
+    type: tcp
+    address: ":8388"
+keys:
+  - id: internal-only
+    cipher: AEAD_AES_128_GCM
+    secret: internal-secret
+    listeners: [internal]
+`
+	_, err := loadConfig(writeTestConfig(t, yaml))
+	if err == nil {
+		t.Fatalf("expected an error for a listener with no usable keys")
+	}
+}
+
+func TestLoadConfigDedupesRepeatedKeys(t *testing.T) {
+	const yaml = `
+listeners:
+  - name: a
+    type: tcp
+    address: ":8388"
+  - name: b
+    type: tcp
+    address: ":8389"
+keys:
+  - id: shared
+    cipher: AEAD_AES_128_GCM
+    secret: shared-secret
+`
+	services, err := loadConfig(writeTestConfig(t, yaml))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if len(services) != 2 {
+		t.Fatalf("got %d services, want 2", len(services))
+	}
+	if services[0].Keys[0].Cipher != services[1].Keys[0].Cipher {
+		t.Fatalf("the same key on two listeners should reuse one cipher instance, not construct it twice")
+	}
+}
+
+func TestKeyAppliesTo(t *testing.T) {
+	unscoped := KeyConfig{ID: "a"}
+	if !keyAppliesTo(unscoped, "any-listener") {
+		t.Fatalf("a key with no Listeners should apply everywhere")
+	}
+
+	scoped := KeyConfig{ID: "b", Listeners: []string{"internal"}}
+	if keyAppliesTo(scoped, "public") {
+		t.Fatalf("a scoped key should not apply to a listener it doesn't name")
+	}
+	if !keyAppliesTo(scoped, "internal") {
+		t.Fatalf("a scoped key should apply to a listener it names")
+	}
+}
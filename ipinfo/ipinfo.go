@@ -0,0 +1,28 @@
+// Package ipinfo resolves client IP addresses to geographic/network
+// metadata for metrics and access logs, via a pluggable backend.
+package ipinfo
+
+import "net"
+
+// Info is the result of resolving an IP address.
+type Info struct {
+	// Country is the ISO 3166-1 alpha-2 country code, or "" if unknown.
+	Country string
+	// ASN is the autonomous system, formatted like "AS15169", or "" if unknown.
+	ASN string
+}
+
+// Source resolves IP addresses to Info. Implementations must be safe for
+// concurrent use and should be lock-free on the lookup hot path.
+type Source interface {
+	Lookup(ip net.IP) (Info, error)
+}
+
+// NoopSource is a Source that never resolves anything. It is the default
+// when no GeoIP database is configured.
+type NoopSource struct{}
+
+// Lookup implements Source.
+func (NoopSource) Lookup(net.IP) (Info, error) {
+	return Info{}, nil
+}
@@ -0,0 +1,117 @@
+package ipinfo
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// MMDBSource resolves addresses using a MaxMind MMDB database (Country,
+// City, or ASN). Reload swaps in a freshly loaded database; the superseded
+// one is reference-counted and only closed once every Lookup already using
+// it has returned, so a reload never invalidates a lookup in flight.
+type MMDBSource struct {
+	db atomic.Pointer[mmdbHandle]
+}
+
+// mmdbReader is the subset of *maxminddb.Reader that MMDBSource needs. It
+// exists so tests can substitute a fake database to exercise reload
+// reference-counting without a real MMDB file.
+type mmdbReader interface {
+	Lookup(ip net.IP, result interface{}) error
+	Close() error
+}
+
+// mmdbHandle pairs a database with a count of its active borrowers. refs
+// starts at 1 for the reference held by MMDBSource.db itself; Reload drops
+// that reference once it has installed a replacement, and the handle closes
+// its database as soon as refs reaches zero.
+type mmdbHandle struct {
+	db   mmdbReader
+	refs int32
+}
+
+// acquire borrows the handle for the duration of one Lookup, returning false
+// if it has already been retired (in which case the caller should re-Load
+// the current handle and try again).
+func (h *mmdbHandle) acquire() bool {
+	for {
+		refs := atomic.LoadInt32(&h.refs)
+		if refs <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&h.refs, refs, refs+1) {
+			return true
+		}
+	}
+}
+
+// release returns a borrowed or installed reference, closing the underlying
+// database once the last one is returned.
+func (h *mmdbHandle) release() {
+	if atomic.AddInt32(&h.refs, -1) == 0 {
+		h.db.Close()
+	}
+}
+
+// NewMMDBSource loads the MMDB file at path and returns a ready-to-use source.
+func NewMMDBSource(path string) (*MMDBSource, error) {
+	s := &MMDBSource{}
+	if err := s.Reload(path); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload replaces the database with a freshly loaded copy of path. The
+// previous database stays open until every Lookup already reading from it
+// has returned.
+func (s *MMDBSource) Reload(path string) error {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open GeoIP database %s: %w", path, err)
+	}
+	newHandle := &mmdbHandle{db: db, refs: 1}
+	if old := s.db.Swap(newHandle); old != nil {
+		old.release()
+	}
+	return nil
+}
+
+// mmdbRecord covers the fields we read from MaxMind's Country, City, and
+// ASN database schemas; databases that lack a field simply leave it zero.
+type mmdbRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	AutonomousSystemNumber uint32 `maxminddb:"autonomous_system_number"`
+}
+
+// Lookup implements Source.
+func (s *MMDBSource) Lookup(ip net.IP) (Info, error) {
+	var h *mmdbHandle
+	for {
+		h = s.db.Load()
+		if h == nil {
+			return Info{}, nil
+		}
+		if h.acquire() {
+			break
+		}
+		// h was retired by a concurrent Reload between Load and acquire;
+		// s.db already points at the replacement, so retry against that.
+	}
+	defer h.release()
+
+	var record mmdbRecord
+	if err := h.db.Lookup(ip, &record); err != nil {
+		return Info{}, err
+	}
+	info := Info{Country: record.Country.ISOCode}
+	if record.AutonomousSystemNumber != 0 {
+		info.ASN = fmt.Sprintf("AS%d", record.AutonomousSystemNumber)
+	}
+	return info, nil
+}
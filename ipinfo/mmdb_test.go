@@ -0,0 +1,96 @@
+package ipinfo
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeMMDBReader stands in for a *maxminddb.Reader so reload safety can be
+// tested without a real MMDB file. Close marks the reader closed and closes
+// the release channel, so a test can observe when the reader was closed.
+type fakeMMDBReader struct {
+	closed  int32
+	release chan struct{}
+}
+
+func newFakeMMDBReader() *fakeMMDBReader {
+	return &fakeMMDBReader{release: make(chan struct{})}
+}
+
+func (f *fakeMMDBReader) Lookup(ip net.IP, result interface{}) error {
+	if atomic.LoadInt32(&f.closed) != 0 {
+		panic("Lookup called after Close")
+	}
+	return nil
+}
+
+func (f *fakeMMDBReader) Close() error {
+	atomic.StoreInt32(&f.closed, 1)
+	close(f.release)
+	return nil
+}
+
+// TestMMDBSourceReloadWaitsForInFlightLookup reproduces the race the
+// refcounting in acquire/release guards against: Reload must not let the
+// superseded reader's Close run while a Lookup still holds it.
+func TestMMDBSourceReloadWaitsForInFlightLookup(t *testing.T) {
+	oldReader := newFakeMMDBReader()
+	s := &MMDBSource{}
+	s.db.Store(&mmdbHandle{db: oldReader, refs: 1})
+
+	h := s.db.Load()
+	if !h.acquire() {
+		t.Fatalf("acquire on a fresh handle should always succeed")
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.db.Store(&mmdbHandle{db: newFakeMMDBReader(), refs: 1})
+		h.release() // drop Reload's own reference, as Reload would via old.release()
+	}()
+
+	select {
+	case <-oldReader.release:
+		t.Fatalf("old reader was closed while a Lookup still held a reference to it")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	h.release() // the in-flight Lookup finishes
+	wg.Wait()
+
+	select {
+	case <-oldReader.release:
+	case <-time.After(time.Second):
+		t.Fatalf("old reader was never closed after its last reference was released")
+	}
+}
+
+func TestMMDBHandleAcquireAfterRetire(t *testing.T) {
+	h := &mmdbHandle{db: newFakeMMDBReader(), refs: 1}
+	h.release()
+	if h.acquire() {
+		t.Fatalf("acquire should fail once refs has reached zero")
+	}
+}
+
+// BenchmarkMMDBSourceLookup measures the cost of Lookup's hot path, which
+// must stay allocation-light and lock-free: concurrent lookups share only
+// an atomic reference count on the current database, never a mutex.
+func BenchmarkMMDBSourceLookup(b *testing.B) {
+	s := &MMDBSource{}
+	s.db.Store(&mmdbHandle{db: newFakeMMDBReader(), refs: 1})
+	ip := net.IPv4(8, 8, 8, 8)
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := s.Lookup(ip); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// newLogger builds the root logger from the -log-format and -log-level
+// flags. format defaults to "text" when stdout is a terminal and "json"
+// otherwise, so interactive runs stay readable while piped/production runs
+// emit machine-parseable logs.
+func newLogger(format, level string) *slog.Logger {
+	if format == "" {
+		if isTerminal(os.Stdout) {
+			format = "text"
+		} else {
+			format = "json"
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: parseLogLevel(level)}
+	var handler slog.Handler
+	if strings.EqualFold(format, "json") {
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	}
+	return slog.New(handler)
+}
+
+func parseLogLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return (fi.Mode() & os.ModeCharDevice) != 0
+}
@@ -0,0 +1,29 @@
+package service
+
+import (
+	"log/slog"
+
+	ssnet "github.com/shadowsocks/go-shadowsocks2/net"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+)
+
+// AuthenticateFunc inspects the start of a client connection, selects the
+// matching access key, and returns its ID and index along with a DuplexConn
+// that has the shadowsocks framing already applied. logger receives the
+// per-connection context the caller has accumulated so far.
+type AuthenticateFunc func(clientConn ssnet.DuplexConn, logger *slog.Logger) (accessKeyID string, cipherIndex int, conn ssnet.DuplexConn, err error)
+
+// NewShadowsocksStreamAuthenticator returns an AuthenticateFunc that tries
+// each of keys against the connection's handshake, the way findCipher always
+// has, and wraps the connection with the winning cipher. replayCache may be
+// nil, in which case handshakes are never rejected as replays.
+func NewShadowsocksStreamAuthenticator(keys []AccessKey, replayCache *ReplayCache) AuthenticateFunc {
+	return func(clientConn ssnet.DuplexConn, logger *slog.Logger) (string, int, ssnet.DuplexConn, error) {
+		cipher, index, shadowReader, err := findCipher(clientConn, keys, replayCache, logger)
+		if err != nil {
+			return "", -1, nil, err
+		}
+		shadowWriter := shadowaead.NewShadowsocksWriter(clientConn, cipher)
+		return keys[index].ID, index, ssnet.WrapDuplexConn(clientConn, shadowReader, shadowWriter), nil
+	}
+}
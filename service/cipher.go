@@ -0,0 +1,116 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+)
+
+// AccessKey is a single shadowsocks cipher identified by a human-readable ID
+// used in metrics and logs.
+type AccessKey struct {
+	ID     string
+	Cipher shadowaead.Cipher
+}
+
+// ErrReplay is returned by findCipher when an otherwise-valid handshake
+// reuses a salt already present in the replay cache.
+var ErrReplay = errors.New("replay detected")
+
+// cipherTrialWorkers bounds how many candidate ciphers are trialed at once,
+// so a long access-key list doesn't spawn unbounded goroutines per connection.
+const cipherTrialWorkers = 8
+
+type cipherTrialResult struct {
+	ok     bool
+	replay bool
+}
+
+// findCipher tries every key against the handshake and returns the one that
+// authenticates, along with its index into keys and a Reader that replays
+// the bytes consumed during the trials ahead of the live connection.
+// replayCache may be nil or disabled, in which case no replay check is
+// performed.
+//
+// All candidates are trialed against the same buffered prefix regardless of
+// whether an earlier one already matched, and the result is only acted on
+// once every trial has finished. Success and failure both pad their total
+// latency to the same randomized target, and neither path performs any I/O
+// beyond that padding, so time-to-first-response can't be used to probe
+// whether this is a shadowsocks endpoint, which key it accepts, or to hold
+// a connection open past a normal handshake by trickling bytes.
+func findCipher(clientReader io.Reader, keys []AccessKey, replayCache *ReplayCache, logger *slog.Logger) (shadowaead.Cipher, int, io.Reader, error) {
+	if len(keys) == 0 {
+		return nil, -1, nil, errors.New("empty access key list")
+	}
+	start := time.Now()
+	target := targetResponseDelay()
+
+	// prefix accumulates every byte read from clientReader across all trials,
+	// so the winning cipher's Reader can replay it ahead of the live conn.
+	prefix := newSharedPrefixBuffer(clientReader)
+
+	results := make([]cipherTrialResult, len(keys))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, cipherTrialWorkers)
+	for i, key := range keys {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, key AccessKey) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = tryCipher(i, key, prefix, replayCache, logger)
+		}(i, key)
+	}
+	wg.Wait()
+
+	selected, replayed := -1, false
+	for i, r := range results {
+		if r.ok {
+			selected = i
+			break
+		}
+		replayed = replayed || r.replay
+	}
+
+	if selected == -1 {
+		drainRandomPrefix(prefix.bytes())
+		waitForTargetDelay(start, target)
+		if replayed {
+			replayCacheHits.Inc()
+			return nil, -1, nil, ErrReplay
+		}
+		return nil, -1, nil, fmt.Errorf("could not find valid cipher")
+	}
+
+	waitForTargetDelay(start, target)
+	cipher := keys[selected].Cipher
+	replayReader := io.MultiReader(bytes.NewReader(prefix.bytes()), clientReader)
+	return cipher, selected, shadowaead.NewShadowsocksReader(replayReader, cipher), nil
+}
+
+// tryCipher authenticates one candidate against the shared handshake prefix
+// and, on success, checks its salt for replay.
+func tryCipher(index int, key AccessKey, prefix *sharedPrefixBuffer, replayCache *ReplayCache, logger *slog.Logger) cipherTrialResult {
+	logger.Debug("trying cipher", "cipher_index", index)
+	cipherReader := shadowaead.NewShadowsocksReader(prefix.reader(), key.Cipher)
+	// Read should read just enough data to authenticate the payload size.
+	_, err := cipherReader.Read(make([]byte, 0))
+	if err != nil {
+		logger.Debug("failed cipher", "cipher_index", index, "error", err)
+		return cipherTrialResult{}
+	}
+	buffered := prefix.bytes()
+	if saltSize := key.Cipher.SaltSize(); replayCache.IsReplay(buffered[:min(saltSize, len(buffered))]) {
+		logger.Warn("rejecting cipher: replayed salt", "cipher_index", index)
+		return cipherTrialResult{replay: true}
+	}
+	logger.Debug("cipher authenticated", "cipher_index", index)
+	return cipherTrialResult{ok: true}
+}
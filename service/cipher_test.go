@@ -0,0 +1,114 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/shadowaead"
+)
+
+func testAccessKeys(t *testing.T, n int) []AccessKey {
+	t.Helper()
+	keys := make([]AccessKey, n)
+	for i := range keys {
+		c, err := core.PickCipher("AEAD_AES_128_GCM", nil, fmt.Sprintf("secret-%d", i))
+		if err != nil {
+			t.Fatalf("PickCipher: %v", err)
+		}
+		aead, ok := c.(shadowaead.Cipher)
+		if !ok {
+			t.Fatalf("cipher %T is not AEAD", c)
+		}
+		keys[i] = AccessKey{ID: fmt.Sprint(i), Cipher: aead}
+	}
+	return keys
+}
+
+func validHandshake(t *testing.T, key AccessKey) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := shadowaead.NewShadowsocksWriter(&buf, key.Cipher)
+	if _, err := w.Write([]byte("fake SOCKS target address")); err != nil {
+		t.Fatalf("writing test handshake: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+func TestFindCipherSuccess(t *testing.T) {
+	keys := testAccessKeys(t, 5)
+	handshake := validHandshake(t, keys[3])
+	_, index, _, err := findCipher(bytes.NewReader(handshake), keys, nil, discardLogger())
+	if err != nil {
+		t.Fatalf("findCipher: %v", err)
+	}
+	if index != 3 {
+		t.Fatalf("index = %d, want 3", index)
+	}
+}
+
+func TestFindCipherFailure(t *testing.T) {
+	keys := testAccessKeys(t, 5)
+	garbage := make([]byte, 64)
+	rand.Read(garbage)
+	_, _, _, err := findCipher(bytes.NewReader(garbage), keys, nil, discardLogger())
+	if err == nil {
+		t.Fatalf("findCipher unexpectedly succeeded against garbage input")
+	}
+}
+
+// timingVarianceThreshold is how far apart the average success and failure
+// latencies are allowed to drift in TestFindCipherTimingIsConstant. It must
+// stay well under responseDelayJitter, the padding findCipher itself uses to
+// hide which path a connection took.
+const timingVarianceThreshold = 15 * time.Millisecond
+
+// TestFindCipherTimingIsConstant proves the invariant this package relies
+// on for resisting active probing: a successful and a failed handshake take
+// statistically indistinguishable time, because both are padded to the same
+// randomized target and neither performs I/O beyond that padding.
+func TestFindCipherTimingIsConstant(t *testing.T) {
+	if testing.Short() {
+		t.Skip("timing trial is slow; skipped with -short")
+	}
+	const trials = 40
+	keys := testAccessKeys(t, 8)
+	handshake := validHandshake(t, keys[len(keys)-1])
+	garbage := make([]byte, len(handshake))
+	rand.Read(garbage)
+
+	var successTotal, failureTotal time.Duration
+	for i := 0; i < trials; i++ {
+		start := time.Now()
+		if _, _, _, err := findCipher(bytes.NewReader(handshake), keys, nil, discardLogger()); err != nil {
+			t.Fatalf("findCipher: %v", err)
+		}
+		successTotal += time.Since(start)
+
+		start = time.Now()
+		if _, _, _, err := findCipher(bytes.NewReader(garbage), keys, nil, discardLogger()); err == nil {
+			t.Fatalf("findCipher unexpectedly succeeded against garbage input")
+		}
+		failureTotal += time.Since(start)
+	}
+
+	successAvg := successTotal / trials
+	failureAvg := failureTotal / trials
+	diff := successAvg - failureAvg
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > timingVarianceThreshold {
+		t.Fatalf("average success (%v) and failure (%v) latency differ by %v, want <= %v",
+			successAvg, failureAvg, diff, timingVarianceThreshold)
+	}
+}
@@ -0,0 +1,15 @@
+package service
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// countryBytes tracks bytes relayed per client country, alongside the
+// existing access-key and per-network metrics.
+var countryBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "shadowsocks",
+	Subsystem: "tcp",
+	Name:      "country_bytes_total",
+	Help:      "Bytes relayed per client country.",
+}, []string{"country", "direction"})
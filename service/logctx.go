@@ -0,0 +1,39 @@
+package service
+
+import (
+	"log/slog"
+	"strconv"
+	"sync/atomic"
+)
+
+// ConnContext carries the per-connection fields that every log line for a
+// single connection should include, so the lines for one connection can all
+// be grep'd together by conn_id.
+type ConnContext struct {
+	ConnID      string
+	ClientIP    string
+	AccessKey   string
+	Target      string
+	CipherIndex int
+	Country     string
+}
+
+// Logger returns a child of base with this context's fields attached.
+func (c *ConnContext) Logger(base *slog.Logger) *slog.Logger {
+	return base.With(
+		"conn_id", c.ConnID,
+		"client_ip", c.ClientIP,
+		"access_key", c.AccessKey,
+		"target", c.Target,
+		"cipher_index", c.CipherIndex,
+		"country", c.Country,
+	)
+}
+
+var nextConnID int64
+
+// newConnID returns a process-unique, monotonically increasing connection
+// identifier suitable for grepping a single connection's log lines.
+func newConnID() string {
+	return strconv.FormatInt(atomic.AddInt64(&nextConnID, 1), 10)
+}
@@ -0,0 +1,27 @@
+package service
+
+import (
+	"errors"
+	"net"
+)
+
+// netKey returns the /24 (IPv4) or /32 (IPv6) network containing addr, used
+// to group per-client metrics without keying on the full IP.
+func netKey(addr net.Addr) (string, error) {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return "", err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", errors.New("failed to parse ip")
+	}
+	ipNet := net.IPNet{IP: ip}
+	if ip.To4() != nil {
+		ipNet.Mask = net.CIDRMask(24, 32)
+	} else {
+		ipNet.Mask = net.CIDRMask(32, 128)
+	}
+	ipNet.IP = ip.Mask(ipNet.Mask)
+	return ipNet.String(), nil
+}
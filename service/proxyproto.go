@@ -0,0 +1,144 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	ssnet "github.com/shadowsocks/go-shadowsocks2/net"
+)
+
+// ErrProxyProto is returned when a PROXY protocol header cannot be parsed.
+var ErrProxyProto = errors.New("malformed PROXY protocol header")
+
+var proxyProtoV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// maxProxyProtoV1Line is the longest a v1 text header is allowed to be, per spec.
+const maxProxyProtoV1Line = 107
+
+// proxyProtoConn overrides RemoteAddr with the address decoded from a PROXY
+// protocol header, reading the rest of the stream through the buffered
+// reader used to parse that header.
+type proxyProtoConn struct {
+	ssnet.DuplexConn
+	r          *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.DuplexConn.RemoteAddr()
+}
+
+// decodeProxyProto reads a PROXY protocol v1 or v2 header from the start of
+// conn and returns a DuplexConn whose RemoteAddr reflects the original
+// client address, so that netKey, logging, and per-network metrics
+// attribute the connection correctly. healthCheck reports whether this was
+// a v2 LOCAL command (e.g. a load balancer health check), which callers
+// should accept and close without proxying any payload.
+func decodeProxyProto(conn ssnet.DuplexConn) (out ssnet.DuplexConn, healthCheck bool, err error) {
+	r := bufio.NewReaderSize(conn, maxProxyProtoV1Line)
+	prefix, err := r.Peek(len(proxyProtoV2Signature))
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %v", ErrProxyProto, err)
+	}
+
+	if bytes.Equal(prefix, proxyProtoV2Signature) {
+		remoteAddr, healthCheck, err := decodeProxyProtoV2(r)
+		if err != nil {
+			return nil, false, err
+		}
+		return &proxyProtoConn{DuplexConn: conn, r: r, remoteAddr: remoteAddr}, healthCheck, nil
+	}
+	if bytes.HasPrefix(prefix, []byte("PROXY")) {
+		remoteAddr, err := decodeProxyProtoV1(r)
+		if err != nil {
+			return nil, false, err
+		}
+		return &proxyProtoConn{DuplexConn: conn, r: r, remoteAddr: remoteAddr}, false, nil
+	}
+	return nil, false, fmt.Errorf("%w: unrecognized header", ErrProxyProto)
+}
+
+func decodeProxyProtoV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadString('\n')
+	if err != nil || len(line) > maxProxyProtoV1Line {
+		return nil, fmt.Errorf("%w: %v", ErrProxyProto, err)
+	}
+	fields := strings.Fields(strings.TrimRight(line, "\r\n"))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("%w: malformed v1 header", ErrProxyProto)
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("%w: malformed v1 header", ErrProxyProto)
+	}
+	srcIP := net.ParseIP(fields[2])
+	if srcIP == nil {
+		return nil, fmt.Errorf("%w: invalid source address", ErrProxyProto)
+	}
+	srcPort, err := strconv.Atoi(fields[4])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid source port", ErrProxyProto)
+	}
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, nil
+}
+
+func decodeProxyProtoV2(r *bufio.Reader) (net.Addr, bool, error) {
+	if _, err := r.Discard(len(proxyProtoV2Signature)); err != nil {
+		return nil, false, fmt.Errorf("%w: %v", ErrProxyProto, err)
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, false, fmt.Errorf("%w: %v", ErrProxyProto, err)
+	}
+	verCmd, famProto := header[0], header[1]
+	if verCmd>>4 != 2 {
+		return nil, false, fmt.Errorf("%w: unsupported version", ErrProxyProto)
+	}
+	cmd := verCmd & 0x0F
+	length := binary.BigEndian.Uint16(header[2:4])
+	addr := make([]byte, length)
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return nil, false, fmt.Errorf("%w: %v", ErrProxyProto, err)
+	}
+	if cmd == 0x00 {
+		// LOCAL: no real connection to proxy, e.g. a health check.
+		return nil, true, nil
+	}
+	if cmd != 0x01 {
+		return nil, false, fmt.Errorf("%w: unsupported command", ErrProxyProto)
+	}
+
+	switch famProto >> 4 {
+	case 0x1: // AF_INET
+		if len(addr) < 12 {
+			return nil, false, fmt.Errorf("%w: short IPv4 address block", ErrProxyProto)
+		}
+		srcPort := binary.BigEndian.Uint16(addr[8:10])
+		return &net.TCPAddr{IP: net.IP(addr[0:4]), Port: int(srcPort)}, false, nil
+	case 0x2: // AF_INET6
+		if len(addr) < 36 {
+			return nil, false, fmt.Errorf("%w: short IPv6 address block", ErrProxyProto)
+		}
+		srcPort := binary.BigEndian.Uint16(addr[32:34])
+		return &net.TCPAddr{IP: net.IP(addr[0:16]), Port: int(srcPort)}, false, nil
+	default:
+		// AF_UNSPEC: no address was carried; proxy with the original RemoteAddr.
+		return nil, false, nil
+	}
+}
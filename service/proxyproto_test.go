@@ -0,0 +1,126 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	ssnet "github.com/shadowsocks/go-shadowsocks2/net"
+)
+
+// fakeDuplexConn adapts an io.Reader/io.Writer pair to ssnet.DuplexConn for
+// feeding fixed handshake bytes through decodeProxyProto.
+type fakeDuplexConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *fakeDuplexConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *fakeDuplexConn) Write(p []byte) (int, error) { return io.Discard.Write(p) }
+func (c *fakeDuplexConn) CloseRead() error            { return nil }
+func (c *fakeDuplexConn) CloseWrite() error           { return nil }
+func (c *fakeDuplexConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}
+}
+
+func newFakeConn(data []byte) ssnet.DuplexConn {
+	return &fakeDuplexConn{r: bytes.NewReader(data)}
+}
+
+func TestDecodeProxyProtoV1(t *testing.T) {
+	conn := newFakeConn([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\nhello"))
+	decoded, healthCheck, err := decodeProxyProto(conn)
+	if err != nil {
+		t.Fatalf("decodeProxyProto: %v", err)
+	}
+	if healthCheck {
+		t.Fatalf("v1 TCP4 header should not be a health check")
+	}
+	if got, want := decoded.RemoteAddr().String(), "192.0.2.1:56324"; got != want {
+		t.Fatalf("RemoteAddr = %q, want %q", got, want)
+	}
+	rest, err := io.ReadAll(decoded)
+	if err != nil {
+		t.Fatalf("reading payload: %v", err)
+	}
+	if string(rest) != "hello" {
+		t.Fatalf("payload = %q, want %q", rest, "hello")
+	}
+}
+
+func TestDecodeProxyProtoV1Unknown(t *testing.T) {
+	conn := newFakeConn([]byte("PROXY UNKNOWN\r\nhello"))
+	decoded, _, err := decodeProxyProto(conn)
+	if err != nil {
+		t.Fatalf("decodeProxyProto: %v", err)
+	}
+	if got, want := decoded.RemoteAddr().String(), conn.RemoteAddr().String(); got != want {
+		t.Fatalf("RemoteAddr = %q, want the original conn address %q", got, want)
+	}
+}
+
+func TestDecodeProxyProtoV2(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(proxyProtoV2Signature)
+	buf.WriteByte(0x21) // version 2, command PROXY
+	buf.WriteByte(0x11) // AF_INET, STREAM
+	addr := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0x01, 0xbb}
+	buf.WriteByte(byte(len(addr) >> 8))
+	buf.WriteByte(byte(len(addr)))
+	buf.Write(addr)
+	buf.WriteString("hello")
+
+	decoded, healthCheck, err := decodeProxyProto(newFakeConn(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("decodeProxyProto: %v", err)
+	}
+	if healthCheck {
+		t.Fatalf("v2 PROXY command should not be a health check")
+	}
+	if got, want := decoded.RemoteAddr().String(), "192.0.2.1:56324"; got != want {
+		t.Fatalf("RemoteAddr = %q, want %q", got, want)
+	}
+	rest, err := io.ReadAll(decoded)
+	if err != nil {
+		t.Fatalf("reading payload: %v", err)
+	}
+	if string(rest) != "hello" {
+		t.Fatalf("payload = %q, want %q", rest, "hello")
+	}
+}
+
+func TestDecodeProxyProtoV2Local(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(proxyProtoV2Signature)
+	buf.WriteByte(0x20) // version 2, command LOCAL
+	buf.WriteByte(0x00) // AF_UNSPEC
+	buf.WriteByte(0)
+	buf.WriteByte(0)
+
+	_, healthCheck, err := decodeProxyProto(newFakeConn(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("decodeProxyProto: %v", err)
+	}
+	if !healthCheck {
+		t.Fatalf("v2 LOCAL command should be reported as a health check")
+	}
+}
+
+func TestDecodeProxyProtoMalformed(t *testing.T) {
+	_, _, err := decodeProxyProto(newFakeConn([]byte("not a proxy header")))
+	if !errors.Is(err, ErrProxyProto) {
+		t.Fatalf("err = %v, want ErrProxyProto", err)
+	}
+}
+
+func TestDecodeProxyProtoV1LineTooLong(t *testing.T) {
+	line := "PROXY TCP4 " + strings.Repeat("0", maxProxyProtoV1Line) + "\r\n"
+	r := bufio.NewReaderSize(strings.NewReader(line), maxProxyProtoV1Line)
+	if _, err := decodeProxyProtoV1(r); !errors.Is(err, ErrProxyProto) {
+		t.Fatalf("err = %v, want ErrProxyProto", err)
+	}
+}
@@ -0,0 +1,63 @@
+package service
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var replayCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "shadowsocks",
+	Subsystem: "replay",
+	Name:      "cache_hits_total",
+	Help:      "Handshakes rejected because their salt had already been seen.",
+})
+
+// ReplayCache is a bounded, thread-safe cache of the salts observed in
+// recent AEAD handshakes, used to reject connections that replay a
+// previously seen handshake.
+type ReplayCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	index    map[string]*list.Element
+}
+
+// NewReplayCache returns a ReplayCache that remembers up to capacity salts.
+// A capacity of 0 disables the cache: IsReplay always reports false.
+func NewReplayCache(capacity int) *ReplayCache {
+	return &ReplayCache{
+		capacity: capacity,
+		ll:       list.New(),
+		index:    make(map[string]*list.Element),
+	}
+}
+
+// IsReplay reports whether salt has already been seen, recording it as seen
+// if not. It is safe for concurrent use by multiple goroutines.
+func (c *ReplayCache) IsReplay(salt []byte) bool {
+	if c == nil || c.capacity == 0 {
+		return false
+	}
+	key := string(salt)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.index[key]; ok {
+		c.ll.MoveToFront(elem)
+		return true
+	}
+	c.index[key] = c.ll.PushFront(key)
+	for c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		if oldest == nil {
+			break
+		}
+		c.ll.Remove(oldest)
+		delete(c.index, oldest.Value.(string))
+	}
+	return false
+}
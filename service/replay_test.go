@@ -0,0 +1,56 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestReplayCache(t *testing.T) {
+	c := NewReplayCache(2)
+	if c.IsReplay([]byte("salt-a")) {
+		t.Fatalf("a fresh salt must not be reported as a replay")
+	}
+	if !c.IsReplay([]byte("salt-a")) {
+		t.Fatalf("a repeated salt must be reported as a replay")
+	}
+	if c.IsReplay([]byte("salt-b")) {
+		t.Fatalf("a second fresh salt must not be reported as a replay")
+	}
+	// Evict salt-a: capacity is 2, and salt-b was the most recently touched.
+	if c.IsReplay([]byte("salt-c")) {
+		t.Fatalf("a third fresh salt must not be reported as a replay")
+	}
+	if c.IsReplay([]byte("salt-a")) {
+		t.Fatalf("salt-a should have been evicted once the cache exceeded capacity")
+	}
+}
+
+func TestReplayCacheDisabled(t *testing.T) {
+	c := NewReplayCache(0)
+	if c.IsReplay([]byte("salt-a")) || c.IsReplay([]byte("salt-a")) {
+		t.Fatalf("a zero-capacity cache must never report a replay")
+	}
+}
+
+func TestReplayCacheNil(t *testing.T) {
+	var c *ReplayCache
+	if c.IsReplay([]byte("salt-a")) {
+		t.Fatalf("a nil cache must behave like a disabled one")
+	}
+}
+
+// BenchmarkReplayCacheIsReplay measures the per-connection overhead the
+// replay cache adds to a handshake: one IsReplay call against a cache sized
+// like a busy deployment's recent-handshake history.
+func BenchmarkReplayCacheIsReplay(b *testing.B) {
+	const capacity = 1 << 16
+	c := NewReplayCache(capacity)
+	salts := make([][]byte, b.N)
+	for i := range salts {
+		salts[i] = []byte(fmt.Sprintf("salt-%d", i))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.IsReplay(salts[i])
+	}
+}
@@ -0,0 +1,60 @@
+package service
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// sharedPrefixBuffer lets multiple independent readers consume the same
+// growing prefix of src concurrently: each reader session tracks its own
+// read position, and only one of them actually reads from src at a time
+// (serialized by mu) when the shared buffer runs dry. This lets every
+// candidate cipher in findCipher read from the same handshake bytes without
+// racing on the underlying connection.
+type sharedPrefixBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+	src io.Reader
+}
+
+func newSharedPrefixBuffer(src io.Reader) *sharedPrefixBuffer {
+	return &sharedPrefixBuffer{src: src}
+}
+
+// reader returns an io.Reader over the shared prefix, starting at offset 0.
+func (s *sharedPrefixBuffer) reader() io.Reader {
+	return &sharedPrefixReader{sb: s}
+}
+
+// bytes returns a copy of everything read from src so far; later reads
+// through any session do not change the returned slice.
+func (s *sharedPrefixBuffer) bytes() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]byte(nil), s.buf.Bytes()...)
+}
+
+type sharedPrefixReader struct {
+	sb  *sharedPrefixBuffer
+	pos int
+}
+
+func (r *sharedPrefixReader) Read(p []byte) (int, error) {
+	r.sb.mu.Lock()
+	defer r.sb.mu.Unlock()
+
+	if r.pos >= r.sb.buf.Len() {
+		fetched := make([]byte, len(p))
+		n, err := r.sb.src.Read(fetched)
+		if n > 0 {
+			r.sb.buf.Write(fetched[:n])
+		}
+		if n == 0 && err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.sb.buf.Bytes()[r.pos:])
+	r.pos += n
+	return n, nil
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	ssnet "github.com/shadowsocks/go-shadowsocks2/net"
+)
+
+// StreamHandler handles a single already-accepted stream connection. It is
+// the extension point that lets a caller embed this package's listener loop
+// while swapping in its own connection handling.
+type StreamHandler interface {
+	Handle(ctx context.Context, conn ssnet.DuplexConn)
+}
+
+// Serve accepts connections from l and dispatches each to handler on its own
+// goroutine, until ctx is canceled or Accept returns an error. Serve itself
+// does not return until every dispatched handler has returned, so a caller
+// that waits on Serve before exiting gets an actual graceful shutdown rather
+// than just closing the listener.
+func Serve(ctx context.Context, l net.Listener, handler StreamHandler) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	var handlers sync.WaitGroup
+	defer handlers.Wait()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			default:
+				return err
+			}
+		}
+		duplexConn, ok := conn.(ssnet.DuplexConn)
+		if !ok {
+			conn.Close()
+			continue
+		}
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			handler.Handle(ctx, duplexConn)
+		}()
+	}
+}
@@ -0,0 +1,192 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/fortuna/ss-example/ipinfo"
+	"github.com/fortuna/ss-example/metrics"
+	ssnet "github.com/shadowsocks/go-shadowsocks2/net"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// defaultHandshakeTimeout bounds how long the handshake phase (cipher
+// discovery plus the SOCKS target address) is allowed to take before a
+// connection is abandoned.
+const defaultHandshakeTimeout = 5 * time.Second
+
+// TCPHandler is a StreamHandler that terminates a shadowsocks TCP stream and
+// relays it to the SOCKS target address embedded in the handshake.
+type TCPHandler struct {
+	authenticate     AuthenticateFunc
+	metrics          metrics.TCPMetrics
+	logger           *slog.Logger
+	handshakeTimeout time.Duration
+	proxyProtocol    bool
+	geoip            ipinfo.Source
+
+	accessKeyMetrics *metrics.MetricsMap
+	netMetrics       *metrics.MetricsMap
+}
+
+// NewTCPHandler creates a TCPHandler that authenticates connections with
+// authenticate and reports to m. The logger defaults to a discard logger and
+// the handshake timeout to defaultHandshakeTimeout; use SetLogger and
+// SetHandshakeTimeout to override either.
+func NewTCPHandler(authenticate AuthenticateFunc, m metrics.TCPMetrics) *TCPHandler {
+	return &TCPHandler{
+		authenticate:     authenticate,
+		metrics:          m,
+		logger:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+		handshakeTimeout: defaultHandshakeTimeout,
+		geoip:            ipinfo.NoopSource{},
+		accessKeyMetrics: metrics.NewMetricsMap(),
+		netMetrics:       metrics.NewMetricsMap(),
+	}
+}
+
+// SetLogger overrides the discard logger used by default.
+func (h *TCPHandler) SetLogger(l *slog.Logger) {
+	h.logger = l
+}
+
+// SetHandshakeTimeout overrides the read deadline applied while the
+// connection authenticates and reads its SOCKS target. A zero duration
+// disables the deadline.
+func (h *TCPHandler) SetHandshakeTimeout(d time.Duration) {
+	h.handshakeTimeout = d
+}
+
+// SetProxyProtocol enables decoding a PROXY protocol v1 or v2 header at the
+// start of each connection, so that connections arriving through an L4 load
+// balancer are attributed to the original client address.
+func (h *TCPHandler) SetProxyProtocol(enabled bool) {
+	h.proxyProtocol = enabled
+}
+
+// SetGeoIPSource overrides the ipinfo.NoopSource used by default, enabling
+// per-connection country enrichment.
+func (h *TCPHandler) SetGeoIPSource(s ipinfo.Source) {
+	h.geoip = s
+}
+
+// Handle implements StreamHandler.
+func (h *TCPHandler) Handle(ctx context.Context, clientConn ssnet.DuplexConn) {
+	h.metrics.AddTCPConnection()
+	defer clientConn.Close()
+	connStart := time.Now()
+	if tcpConn, ok := clientConn.(*net.TCPConn); ok {
+		tcpConn.SetKeepAlive(true)
+	}
+	status := "OK"
+
+	// The handshake timeout must cover the PROXY protocol header too: it's
+	// read with blocking calls before any of the shadowsocks handshake, so a
+	// connection that opens and never finishes sending it would otherwise
+	// hang the handler goroutine indefinitely instead of being bounded like
+	// the rest of the handshake phase.
+	if h.handshakeTimeout > 0 {
+		clientConn.SetReadDeadline(time.Now().Add(h.handshakeTimeout))
+	}
+
+	if h.proxyProtocol {
+		decoded, isHealthCheck, err := decodeProxyProto(clientConn)
+		if err != nil {
+			h.logger.Warn("malformed PROXY protocol header", "error", err)
+			status = "ERR_PROXY_PROTO"
+			h.metrics.RemoveTCPConnection("INVALID", status, time.Since(connStart))
+			return
+		}
+		clientConn = decoded
+		if isHealthCheck {
+			h.logger.Debug("accepted PROXY protocol health check")
+			return
+		}
+	}
+
+	connCtx := &ConnContext{ConnID: newConnID(), ClientIP: clientConn.RemoteAddr().String()}
+	if host, _, err := net.SplitHostPort(connCtx.ClientIP); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			if info, err := h.geoip.Lookup(ip); err == nil {
+				connCtx.Country = info.Country
+			}
+		}
+	}
+	logger := connCtx.Logger(h.logger)
+
+	accessKey := "INVALID"
+	key, err := netKey(clientConn.RemoteAddr())
+	if err != nil {
+		key = "INVALID"
+	}
+	var proxyMetrics metrics.ProxyMetrics
+	defer func() {
+		connDuration := time.Since(connStart)
+		logger.Debug("connection done", "status", status, "duration", connDuration)
+		h.metrics.RemoveTCPConnection(accessKey, status, connDuration)
+		h.accessKeyMetrics.Add(accessKey, proxyMetrics)
+		logger.Debug("access key totals", "key", accessKey, "metrics", metrics.SPrintMetrics(h.accessKeyMetrics.Get(accessKey)))
+		h.netMetrics.Add(key, proxyMetrics)
+		logger.Debug("net totals", "net", key, "metrics", metrics.SPrintMetrics(h.netMetrics.Get(key)))
+		if connCtx.Country != "" {
+			countryBytes.WithLabelValues(connCtx.Country, "client_to_target").Add(float64(proxyMetrics.ClientProxy))
+			countryBytes.WithLabelValues(connCtx.Country, "target_to_client").Add(float64(proxyMetrics.ProxyClient))
+		}
+	}()
+
+	clientConn = metrics.MeasureConn(clientConn, &proxyMetrics.ProxyClient, &proxyMetrics.ClientProxy)
+
+	accessKeyID, cipherIndex, shadowConn, err := h.authenticate(clientConn, logger)
+	if err != nil {
+		logger.Warn("failed to find a valid cipher", "error", err)
+		status = "ERR_CIPHER"
+		if errors.Is(err, ErrReplay) {
+			status = "ERR_REPLAY"
+		}
+		return
+	}
+	accessKey = accessKeyID
+	clientConn = shadowConn
+	connCtx.AccessKey = accessKeyID
+	connCtx.CipherIndex = cipherIndex
+	logger = connCtx.Logger(h.logger)
+
+	tgt, err := socks.ReadAddr(clientConn)
+	if err != nil {
+		logger.Warn("failed to get target address", "error", err)
+		status = "ERR_READ_ADDRESS"
+		return
+	}
+	clientConn.SetReadDeadline(time.Time{})
+	connCtx.Target = tgt.String()
+	logger = connCtx.Logger(h.logger)
+
+	select {
+	case <-ctx.Done():
+		status = "ERR_CANCELED"
+		return
+	default:
+	}
+
+	c, err := net.Dial("tcp", tgt.String())
+	if err != nil {
+		logger.Warn("failed to connect to target", "error", err)
+		status = "ERR_CONNECT"
+		return
+	}
+	var tgtConn ssnet.DuplexConn = c.(*net.TCPConn)
+	defer tgtConn.Close()
+	tgtConn.(*net.TCPConn).SetKeepAlive(true)
+	tgtConn = metrics.MeasureConn(tgtConn, &proxyMetrics.ProxyTarget, &proxyMetrics.TargetProxy)
+
+	logger.Info("proxying")
+	_, _, err = ssnet.Relay(clientConn, tgtConn)
+	if err != nil {
+		logger.Warn("relay error", "error", err)
+		status = "ERR_RELAY"
+	}
+}
@@ -0,0 +1,45 @@
+package service
+
+import (
+	"math/rand"
+	"time"
+)
+
+// responseDelayBase and responseDelayJitter bound the artificial delay
+// applied before findCipher returns, on both the success and failure paths,
+// so that time-to-first-response does not leak whether any cipher matched.
+const (
+	responseDelayBase   = 20 * time.Millisecond
+	responseDelayJitter = 30 * time.Millisecond
+	maxDrainBytes       = 64
+)
+
+// targetResponseDelay draws a delay from the distribution applied to every
+// handshake attempt, win or lose.
+func targetResponseDelay() time.Duration {
+	return responseDelayBase + time.Duration(rand.Int63n(int64(responseDelayJitter)))
+}
+
+// waitForTargetDelay pads the time since start up to target, so two
+// handshakes that started together finish together regardless of outcome.
+func waitForTargetDelay(start time.Time, target time.Duration) {
+	if remaining := target - time.Since(start); remaining > 0 {
+		time.Sleep(remaining)
+	}
+}
+
+// drainRandomPrefix discards a random-length slice of buffered, the bytes
+// already read off the connection while trialing ciphers. It deliberately
+// performs no I/O of its own: buffered is already in memory, so there's
+// nothing to wait on here, and waitForTargetDelay pads whatever time is
+// left to target. Reading further off the live connection at this point
+// would only be bounded by the handshake timeout rather than target,
+// turning the bounded failure path back into one a prober can use to hold a
+// goroutine and socket open far longer than a real handshake takes.
+func drainRandomPrefix(buffered []byte) {
+	n := rand.Intn(maxDrainBytes + 1)
+	if n > len(buffered) {
+		n = len(buffered)
+	}
+	_ = buffered[:n]
+}